@@ -0,0 +1,325 @@
+package courier
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// SmartHost holds the address and SASL credentials to use when relaying
+// mail through a smart host / submission server, instead of delivering
+// directly to the recipient domain's MX hosts.
+type SmartHost struct {
+	// Addr is the "host:port" to connect to.
+	Addr string
+
+	// Username and Password are the SASL credentials to authenticate
+	// with, once TLS is established.
+	Username string
+	Password string
+
+	// RootCAs, if set, is the certificate pool used to verify the smart
+	// host's TLS certificate, instead of the system roots. Since we
+	// always verify a smart host's certificate before authenticating
+	// (credentials must never be sent to an unverified peer), this lets
+	// it use a private CA without chasquid needing to trust that CA
+	// system-wide.
+	RootCAs *x509.CertPool
+}
+
+// AuthConfig maps recipient domains to the smart host to relay through
+// for them. The special domain "*" acts as a catch-all, used for any
+// domain without a more specific entry.
+type AuthConfig struct {
+	Domains map[string]*SmartHost
+}
+
+// authLookup returns the smart host to use for domain, if any, following
+// the same "specific entry, then catch-all" pattern used elsewhere for
+// per-domain configuration.
+func (c AuthConfig) authLookup(domain string) (*SmartHost, bool) {
+	if sh, ok := c.Domains[domain]; ok {
+		return sh, true
+	}
+	if sh, ok := c.Domains["*"]; ok {
+		return sh, true
+	}
+	return nil, false
+}
+
+// saslMechanismPreference lists the SASL mechanisms we support, strongest
+// first. The first one also advertised by the peer is the one we use.
+var saslMechanismPreference = []string{"SCRAM-SHA-256", "CRAM-MD5", "LOGIN", "PLAIN"}
+
+// chooseMechanism picks the strongest mechanism both we and the peer
+// support, out of the peer's AUTH line.
+func chooseMechanism(authLine string) (string, bool) {
+	offered := map[string]bool{}
+	for _, m := range strings.Fields(authLine) {
+		offered[strings.ToUpper(m)] = true
+	}
+	for _, m := range saslMechanismPreference {
+		if offered[m] {
+			return m, true
+		}
+	}
+	return "", false
+}
+
+// auth performs SASL authentication on tc, using the strongest mechanism
+// both sides support. The caller must have already established TLS:
+// authentication failures are always permanent, since retrying with the
+// same credentials won't help.
+func auth(tc *textproto.Conn, e *ehlo, sh *SmartHost) (error, bool) {
+	if !e.has("AUTH") {
+		return fmt.Errorf("AUTH peer does not advertise SASL authentication"), true
+	}
+
+	mech, ok := chooseMechanism(e.params("AUTH"))
+	if !ok {
+		return fmt.Errorf(
+			"AUTH no mutually supported mechanism (peer offers %q)", e.params("AUTH")), true
+	}
+
+	switch mech {
+	case "PLAIN":
+		return authPlain(tc, sh)
+	case "LOGIN":
+		return authLogin(tc, sh)
+	case "CRAM-MD5":
+		return authCRAMMD5(tc, sh)
+	case "SCRAM-SHA-256":
+		return authSCRAMSHA256(tc, sh)
+	}
+	return fmt.Errorf("AUTH unsupported mechanism %q", mech), true
+}
+
+func b64(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+func authPlain(tc *textproto.Conn, sh *SmartHost) (error, bool) {
+	resp := b64("\x00" + sh.Username + "\x00" + sh.Password)
+	id, err := tc.Cmd("AUTH PLAIN %s", resp)
+	if err != nil {
+		return fmt.Errorf("AUTH %v", err), false
+	}
+	tc.StartResponse(id)
+	defer tc.EndResponse(id)
+	if _, _, err := tc.ReadResponse(235); err != nil {
+		return fmt.Errorf("AUTH %v", err), true
+	}
+	return nil, false
+}
+
+func authLogin(tc *textproto.Conn, sh *SmartHost) (error, bool) {
+	id, err := tc.Cmd("AUTH LOGIN")
+	if err != nil {
+		return fmt.Errorf("AUTH %v", err), false
+	}
+	tc.StartResponse(id)
+	_, _, err = tc.ReadResponse(334)
+	tc.EndResponse(id)
+	if err != nil {
+		return fmt.Errorf("AUTH %v", err), true
+	}
+
+	id, err = tc.Cmd("%s", b64(sh.Username))
+	if err != nil {
+		return fmt.Errorf("AUTH %v", err), false
+	}
+	tc.StartResponse(id)
+	_, _, err = tc.ReadResponse(334)
+	tc.EndResponse(id)
+	if err != nil {
+		return fmt.Errorf("AUTH %v", err), true
+	}
+
+	id, err = tc.Cmd("%s", b64(sh.Password))
+	if err != nil {
+		return fmt.Errorf("AUTH %v", err), false
+	}
+	tc.StartResponse(id)
+	defer tc.EndResponse(id)
+	if _, _, err := tc.ReadResponse(235); err != nil {
+		return fmt.Errorf("AUTH %v", err), true
+	}
+	return nil, false
+}
+
+func authCRAMMD5(tc *textproto.Conn, sh *SmartHost) (error, bool) {
+	id, err := tc.Cmd("AUTH CRAM-MD5")
+	if err != nil {
+		return fmt.Errorf("AUTH %v", err), false
+	}
+	tc.StartResponse(id)
+	_, challengeLine, err := tc.ReadResponse(334)
+	tc.EndResponse(id)
+	if err != nil {
+		return fmt.Errorf("AUTH %v", err), true
+	}
+
+	challenge, err := base64.StdEncoding.DecodeString(challengeLine)
+	if err != nil {
+		return fmt.Errorf("AUTH invalid CRAM-MD5 challenge: %v", err), true
+	}
+
+	mac := hmac.New(md5.New, []byte(sh.Password))
+	mac.Write(challenge)
+	digest := hex.EncodeToString(mac.Sum(nil))
+
+	id, err = tc.Cmd("%s", b64(sh.Username+" "+digest))
+	if err != nil {
+		return fmt.Errorf("AUTH %v", err), false
+	}
+	tc.StartResponse(id)
+	defer tc.EndResponse(id)
+	if _, _, err := tc.ReadResponse(235); err != nil {
+		return fmt.Errorf("AUTH %v", err), true
+	}
+	return nil, false
+}
+
+// authSCRAMSHA256 implements the client side of SCRAM-SHA-256 (RFC
+// 7677/5802), including verifying the server's final signature, so a
+// relay in the middle can't simply echo our credentials back at us.
+func authSCRAMSHA256(tc *textproto.Conn, sh *SmartHost) (error, bool) {
+	nonceBytes := make([]byte, 18)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return fmt.Errorf("AUTH failed to generate SCRAM nonce: %v", err), false
+	}
+	clientNonce := base64.StdEncoding.EncodeToString(nonceBytes)
+
+	clientFirstBare := "n=" + scramEscape(sh.Username) + ",r=" + clientNonce
+	clientFirst := "n,," + clientFirstBare
+
+	id, err := tc.Cmd("AUTH SCRAM-SHA-256 %s", b64(clientFirst))
+	if err != nil {
+		return fmt.Errorf("AUTH %v", err), false
+	}
+	tc.StartResponse(id)
+	_, serverFirstB64, err := tc.ReadResponse(334)
+	tc.EndResponse(id)
+	if err != nil {
+		return fmt.Errorf("AUTH %v", err), true
+	}
+
+	serverFirstRaw, err := base64.StdEncoding.DecodeString(serverFirstB64)
+	if err != nil {
+		return fmt.Errorf("AUTH invalid SCRAM server-first message: %v", err), true
+	}
+	serverFirst := string(serverFirstRaw)
+
+	fields := scramFields(serverFirst)
+	nonce, salt64, iterStr := fields["r"], fields["s"], fields["i"]
+	if nonce == "" || salt64 == "" || iterStr == "" || !strings.HasPrefix(nonce, clientNonce) {
+		return fmt.Errorf("AUTH malformed SCRAM server-first message"), true
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return fmt.Errorf("AUTH invalid SCRAM salt: %v", err), true
+	}
+	iterations, err := strconv.Atoi(iterStr)
+	if err != nil || iterations <= 0 {
+		return fmt.Errorf("AUTH invalid SCRAM iteration count"), true
+	}
+
+	saltedPassword := pbkdf2SHA256([]byte(sh.Password), salt, iterations, sha256.Size)
+	clientKey := hmacSum(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	clientFinalWithoutProof := "c=biws,r=" + nonce
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+	clientSignature := hmacSum(storedKey[:], authMessage)
+
+	clientProof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		clientProof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	clientFinal := clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientProof)
+
+	id, err = tc.Cmd("%s", b64(clientFinal))
+	if err != nil {
+		return fmt.Errorf("AUTH %v", err), false
+	}
+	tc.StartResponse(id)
+	_, finalText, err := tc.ReadResponse(235)
+	tc.EndResponse(id)
+	if err != nil {
+		return fmt.Errorf("AUTH %v", err), true
+	}
+
+	// Verify the server's signature, authenticating it to us in turn, so
+	// a relay that merely echoes our credentials can't pass as the real
+	// smart host.
+	serverKey := hmacSum(saltedPassword, "Server Key")
+	serverSignature := hmacSum(serverKey, authMessage)
+	wantV := "v=" + base64.StdEncoding.EncodeToString(serverSignature)
+	if !strings.Contains(finalText, wantV) {
+		return fmt.Errorf("AUTH SCRAM server signature mismatch, possible MITM"), true
+	}
+
+	return nil, false
+}
+
+func hmacSum(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+func scramEscape(s string) string {
+	s = strings.ReplaceAll(s, "=", "=3D")
+	s = strings.ReplaceAll(s, ",", "=2C")
+	return s
+}
+
+func scramFields(s string) map[string]string {
+	out := map[string]string{}
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 {
+			out[kv[0]] = kv[1]
+		}
+	}
+	return out
+}
+
+// pbkdf2SHA256 implements PBKDF2 (RFC 2898) with HMAC-SHA-256 as the
+// pseudorandom function, as used by SCRAM-SHA-256's SaltedPassword step.
+func pbkdf2SHA256(password, salt []byte, iter, keyLen int) []byte {
+	hLen := sha256.Size
+	numBlocks := (keyLen + hLen - 1) / hLen
+
+	dk := make([]byte, 0, numBlocks*hLen)
+	for block := 1; block <= numBlocks; block++ {
+		mac := hmac.New(sha256.New, password)
+		mac.Write(salt)
+		var be [4]byte
+		binary.BigEndian.PutUint32(be[:], uint32(block))
+		mac.Write(be[:])
+		u := mac.Sum(nil)
+
+		t := make([]byte, len(u))
+		copy(t, u)
+		for i := 1; i < iter; i++ {
+			mac := hmac.New(sha256.New, password)
+			mac.Write(u)
+			u = mac.Sum(nil)
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		dk = append(dk, t...)
+	}
+	return dk[:keyLen]
+}
@@ -0,0 +1,139 @@
+package courier
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/testlib"
+)
+
+func TestChooseMechanism(t *testing.T) {
+	cases := []struct {
+		offered  string
+		wantMech string
+		wantOK   bool
+	}{
+		{"PLAIN LOGIN", "LOGIN", true},
+		{"PLAIN LOGIN CRAM-MD5", "CRAM-MD5", true},
+		{"SCRAM-SHA-256 CRAM-MD5 PLAIN", "SCRAM-SHA-256", true},
+		{"PLAIN", "PLAIN", true},
+		{"DIGEST-MD5 GSSAPI", "", false},
+		{"", "", false},
+	}
+
+	for _, c := range cases {
+		mech, ok := chooseMechanism(c.offered)
+		if mech != c.wantMech || ok != c.wantOK {
+			t.Errorf("chooseMechanism(%q) = (%q, %v), want (%q, %v)",
+				c.offered, mech, ok, c.wantMech, c.wantOK)
+		}
+	}
+}
+
+func TestSMTPSmartHostAuth(t *testing.T) {
+	smtpTotalTimeout = 5 * time.Second
+	cert := selfSignedCert(t)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(leaf)
+
+	cases := []struct {
+		responses map[string]string
+		errPrefix string
+	}{
+		// Both PLAIN and LOGIN are offered; LOGIN is stronger in our
+		// preference order, so that's the one that gets used.
+		{
+			makeResp(
+				"_welcome", "220 welcome\n",
+				"EHLO hello", "250-ehlo ok\r\n250 STARTTLS\r\n",
+				"STARTTLS", "220 go ahead\n",
+				"TLS EHLO hello", "250-ehlo ok\r\n250 AUTH PLAIN LOGIN\r\n",
+				"AUTH LOGIN", "334 ok\n",
+				b64("user"), "334 ok\n",
+				b64("pass"), "235 auth ok\n",
+				"MAIL FROM:<me@me>", "250 mail ok\n",
+				"RCPT TO:<to@to>", "250 rcpt ok\n",
+				"DATA", "354 send data\n",
+				"_DATA", "250 data ok\n",
+				"QUIT", "250 quit ok\n",
+			),
+			"",
+		},
+
+		// The peer only offers a mechanism we don't support.
+		{
+			makeResp(
+				"_welcome", "220 welcome\n",
+				"EHLO hello", "250-ehlo ok\r\n250 STARTTLS\r\n",
+				"STARTTLS", "220 go ahead\n",
+				"TLS EHLO hello", "250-ehlo ok\r\n250 AUTH DIGEST-MD5\r\n",
+			),
+			"AUTH no mutually supported mechanism",
+		},
+
+		// The peer doesn't advertise AUTH at all.
+		{
+			makeResp(
+				"_welcome", "220 welcome\n",
+				"EHLO hello", "250-ehlo ok\r\n250 STARTTLS\r\n",
+				"STARTTLS", "220 go ahead\n",
+				"TLS EHLO hello", "250 ehlo ok\n",
+			),
+			"AUTH peer does not advertise SASL authentication",
+		},
+
+		// No STARTTLS offered: we must refuse to send credentials in the
+		// clear.
+		{
+			makeResp(
+				"_welcome", "220 welcome\n",
+				"EHLO hello", "250 ehlo ok\n",
+			),
+			"REQUIRETLS 554",
+		},
+	}
+
+	for _, c := range cases {
+		srv := newFakeServerTLS(t, c.responses, &tls.Config{Certificates: []tls.Certificate{cert}})
+		host, port, _ := net.SplitHostPort(srv.addr)
+
+		s, tmpDir := newSMTP(t)
+		defer testlib.RemoveIfOk(t, tmpDir)
+		s.AuthConfig = AuthConfig{
+			Domains: map[string]*SmartHost{
+				"*": {
+					Addr:     net.JoinHostPort(host, port),
+					Username: "user",
+					Password: "pass",
+					RootCAs:  rootCAs,
+				},
+			},
+		}
+
+		err, _, _ := s.Deliver("me@me", "to@to", []byte("data"), false)
+
+		if c.errPrefix == "" {
+			if err != nil {
+				t.Errorf("deliver failed, expected success: %v", err)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Errorf("deliver succeeded, expected failure %q", c.errPrefix)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), c.errPrefix) {
+			t.Errorf("expected error prefix %q, got %q", c.errPrefix, err)
+		}
+	}
+}
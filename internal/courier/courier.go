@@ -0,0 +1,15 @@
+// Package courier implements the delivery of outgoing mail to remote
+// domains.
+package courier
+
+// Courier implementations take a message that has already been accepted,
+// and attempt to deliver it to its final destination.
+type Courier interface {
+	// Deliver the given mail. requireTLS indicates that the queue marked
+	// this message as requiring TLS (RFC 8689 REQUIRETLS) for its next
+	// hop. Returns an error (nil on success), whether the error is
+	// permanent (true) or transient (false), and the list of SMTP
+	// extensions that were used in the (last) delivery attempt, for
+	// logging/testing purposes.
+	Deliver(from string, to string, data []byte, requireTLS bool) (error, bool, []string)
+}
@@ -0,0 +1,169 @@
+package courier
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/testlib"
+)
+
+func tlsaFor(t *testing.T, cert tls.Certificate, usage, selector uint8) TLSARecord {
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+
+	subject := x509Cert.Raw
+	if selector == daneSelectorSPKI {
+		subject = x509Cert.RawSubjectPublicKeyInfo
+	}
+	sum := sha256.Sum256(subject)
+
+	return TLSARecord{Usage: usage, Selector: selector, MatchingType: daneMatchSHA256, Data: sum[:]}
+}
+
+func TestMatchDANE(t *testing.T) {
+	cert := selfSignedCert(t)
+	other := selfSignedCert(t)
+
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{x509Cert}}
+
+	matching := tlsaFor(t, cert, daneUsageDANEEE, daneSelectorSPKI)
+	if err := matchDANE([]TLSARecord{matching}, state); err != nil {
+		t.Errorf("expected matching TLSA record to verify, got: %v", err)
+	}
+
+	mismatching := tlsaFor(t, other, daneUsageDANEEE, daneSelectorSPKI)
+	if err := matchDANE([]TLSARecord{mismatching}, state); err == nil {
+		t.Errorf("expected mismatching TLSA record to fail verification")
+	}
+
+	unsupported := tlsaFor(t, cert, daneUsagePKIXTA, daneSelectorFullCert)
+	if err := matchDANE([]TLSARecord{unsupported}, state); err == nil {
+		t.Errorf("expected unsupported usage to be ignored, not matched")
+	}
+}
+
+func TestSMTPDANE(t *testing.T) {
+	smtpTotalTimeout = 5 * time.Second
+	cert := selfSignedCert(t)
+
+	responses := makeResp(
+		"_welcome", "220 welcome\n",
+		"EHLO hello", "250-ehlo ok\r\n250 STARTTLS\r\n",
+		"STARTTLS", "220 go ahead\n",
+		"TLS EHLO hello", "250-ehlo ok\r\n250 PIPELINING\r\n",
+		"MAIL FROM:<me@me>", "250 mail ok\n",
+		"RCPT TO:<to@to>", "250 rcpt ok\n",
+		"DATA", "354 send data\n",
+		"_DATA", "250 data ok\n",
+		"QUIT", "250 quit ok\n",
+	)
+	srv := newFakeServerTLS(t, responses, &tls.Config{Certificates: []tls.Certificate{cert}})
+	host, p, _ := net.SplitHostPort(srv.addr)
+
+	testMX["to"] = []*net.MX{{Host: host, Pref: 10}}
+	testTLSA[host] = []TLSARecord{tlsaFor(t, cert, daneUsageDANEEE, daneSelectorSPKI)}
+	defer delete(testTLSA, host)
+	*smtpPort = p
+
+	s, tmpDir := newSMTP(t)
+	defer testlib.RemoveIfOk(t, tmpDir)
+
+	// DANE should force TLS even though requireTLS wasn't requested, and
+	// the matching TLSA record should make the self-signed cert trusted.
+	err, _, exts := s.Deliver("me@me", "to@to", []byte("data"), false)
+	if err != nil {
+		t.Fatalf("deliver failed, expected success: %v", err)
+	}
+
+	found := false
+	for _, e := range exts {
+		if e == "DANE" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected DANE in reported extensions, got %v", exts)
+	}
+}
+
+func TestSMTPDANEMismatch(t *testing.T) {
+	smtpTotalTimeout = 5 * time.Second
+	cert := selfSignedCert(t)
+	other := selfSignedCert(t)
+
+	responses := makeResp(
+		"_welcome", "220 welcome\n",
+		"EHLO hello", "250-ehlo ok\r\n250 STARTTLS\r\n",
+		"STARTTLS", "220 go ahead\n",
+	)
+	srv := newFakeServerTLS(t, responses, &tls.Config{Certificates: []tls.Certificate{cert}})
+	host, p, _ := net.SplitHostPort(srv.addr)
+
+	testMX["to"] = []*net.MX{{Host: host, Pref: 10}}
+	testTLSA[host] = []TLSARecord{tlsaFor(t, other, daneUsageDANEEE, daneSelectorSPKI)}
+	defer delete(testTLSA, host)
+	*smtpPort = p
+
+	s, tmpDir := newSMTP(t)
+	defer testlib.RemoveIfOk(t, tmpDir)
+
+	err, permanent, _ := s.Deliver("me@me", "to@to", []byte("data"), false)
+	if err == nil {
+		t.Fatalf("delivery worked, expected failure due to TLSA mismatch")
+	}
+	// A DANE-only mismatch is transient: it may be a stale TLSA record
+	// during a key-rotation window, and the next attempt (or MX) may
+	// succeed, unlike a REQUIRETLS/smart-host/MTA-STS verified-TLS
+	// failure, which is permanent.
+	if permanent {
+		t.Errorf("expected transient failure, got permanent (%v)", err)
+	}
+	if !strings.Contains(err.Error(), "DANE") {
+		t.Errorf("expected a DANE-related error, got: %v", err)
+	}
+}
+
+func TestDANEDowngrade(t *testing.T) {
+	smtpTotalTimeout = 5 * time.Second
+
+	responses := makeResp(
+		"_welcome", "220 welcome\n",
+		"EHLO hello", "250 ehlo ok\n",
+	)
+	srv := newFakeServer(t, responses)
+	host, p, _ := net.SplitHostPort(srv.addr)
+
+	testMX["to"] = []*net.MX{{Host: host, Pref: 10}}
+	testTLSA[host] = nil
+	defer delete(testTLSA, host)
+	*smtpPort = p
+
+	s, tmpDir := newSMTP(t)
+	defer testlib.RemoveIfOk(t, tmpDir)
+
+	if err := s.DomainInfoDB.SetDANESeen("to", true); err != nil {
+		t.Fatalf("failed to seed DANESeen: %v", err)
+	}
+
+	err, permanent, _ := s.Deliver("me@me", "to@to", []byte("data"), false)
+	if err == nil {
+		t.Fatalf("delivery worked, expected failure due to vanished TLSA records")
+	}
+	if !permanent {
+		t.Errorf("expected permanent failure, got transient (%v)", err)
+	}
+	if !strings.Contains(err.Error(), "downgrade") {
+		t.Errorf("expected a downgrade-related error, got: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package courier
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/mtasts"
+	"blitiri.com.ar/go/chasquid/internal/testlib"
+)
+
+func newMTASTSDB(t *testing.T) *mtasts.DB {
+	dir := testlib.MustTempDir(t)
+	t.Cleanup(func() { testlib.RemoveIfOk(t, dir) })
+
+	db, err := mtasts.New(dir)
+	if err != nil {
+		t.Fatalf("mtasts.New failed: %v", err)
+	}
+	return db
+}
+
+func TestSMTPMTASTSEnforceSuccess(t *testing.T) {
+	smtpTotalTimeout = 5 * time.Second
+	cert := selfSignedCert(t)
+
+	responses := makeResp(
+		"_welcome", "220 welcome\n",
+		"EHLO hello", "250-ehlo ok\r\n250 STARTTLS\r\n",
+		"STARTTLS", "220 go ahead\n",
+		"TLS EHLO hello", "250-ehlo ok\r\n250 PIPELINING\r\n",
+		"MAIL FROM:<me@me>", "250 mail ok\n",
+		"RCPT TO:<to@to>", "250 rcpt ok\n",
+		"DATA", "354 send data\n",
+		"_DATA", "250 data ok\n",
+		"QUIT", "250 quit ok\n",
+	)
+	srv := newFakeServerTLS(t, responses, &tls.Config{Certificates: []tls.Certificate{cert}})
+	host, p, _ := net.SplitHostPort(srv.addr)
+
+	testMX["to"] = []*net.MX{{Host: host, Pref: 10}}
+	// DANE makes the self-signed cert trusted, so we can exercise the
+	// enforced, verified-TLS path without an additional CA-trust seam.
+	testTLSA[host] = []TLSARecord{tlsaFor(t, cert, daneUsageDANEEE, daneSelectorSPKI)}
+	defer delete(testTLSA, host)
+	*smtpPort = p
+
+	s, tmpDir := newSMTP(t)
+	defer testlib.RemoveIfOk(t, tmpDir)
+
+	s.MTASTSDB = newMTASTSDB(t)
+	s.MTASTSDB.SetForTesting("to", &mtasts.Policy{
+		Mode: mtasts.ModeEnforce,
+		MX:   []string{host},
+	})
+
+	err, _, _ := s.Deliver("me@me", "to@to", []byte("data"), false)
+	if err != nil {
+		t.Fatalf("deliver failed, expected success: %v", err)
+	}
+}
+
+func TestSMTPMTASTSEnforceNoMatchingMX(t *testing.T) {
+	testMX["to"] = []*net.MX{{Host: "mail.example.com", Pref: 10}}
+
+	s, tmpDir := newSMTP(t)
+	defer testlib.RemoveIfOk(t, tmpDir)
+
+	s.MTASTSDB = newMTASTSDB(t)
+	s.MTASTSDB.SetForTesting("to", &mtasts.Policy{
+		Mode: mtasts.ModeEnforce,
+		MX:   []string{"mx.other.com"},
+	})
+
+	err, permanent, _ := s.Deliver("me@me", "to@to", []byte("data"), false)
+	if err == nil {
+		t.Fatalf("delivery worked, expected failure due to no matching MX")
+	}
+	if !permanent {
+		t.Errorf("expected permanent failure, got transient (%v)", err)
+	}
+	if !strings.Contains(err.Error(), "MTA-STS") {
+		t.Errorf("expected an MTA-STS-related error, got: %v", err)
+	}
+}
+
+func TestSMTPMTASTSEnforceFailedTLS(t *testing.T) {
+	smtpTotalTimeout = 5 * time.Second
+
+	responses := makeResp(
+		"_welcome", "220 welcome\n",
+		"EHLO hello", "250 ehlo ok\n",
+	)
+	srv := newFakeServer(t, responses)
+	host, p, _ := net.SplitHostPort(srv.addr)
+
+	testMX["to"] = []*net.MX{{Host: host, Pref: 10}}
+	*smtpPort = p
+
+	s, tmpDir := newSMTP(t)
+	defer testlib.RemoveIfOk(t, tmpDir)
+
+	s.MTASTSDB = newMTASTSDB(t)
+	s.MTASTSDB.SetForTesting("to", &mtasts.Policy{
+		Mode: mtasts.ModeEnforce,
+		MX:   []string{host},
+	})
+
+	// The matching MX doesn't offer STARTTLS at all, so the enforced,
+	// verified-TLS requirement can never be satisfied.
+	err, permanent, _ := s.Deliver("me@me", "to@to", []byte("data"), false)
+	if err == nil {
+		t.Fatalf("delivery worked, expected failure due to lack of STARTTLS")
+	}
+	if !permanent {
+		t.Errorf("expected permanent failure, got transient (%v)", err)
+	}
+	if !strings.Contains(err.Error(), "REQUIRETLS") {
+		t.Errorf("expected a verified-TLS-related error, got: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package courier
+
+import (
+	"net"
+	"sort"
+)
+
+// netLookupIP resolves a host to its IP addresses (both A and AAAA); it's
+// a variable so tests can override it, the same way netLookupMX is.
+var netLookupIP = net.LookupIP
+
+// Address scopes, as defined by RFC 6724 section 3.1 (values don't need
+// to match the RFC's numbering, only their relative order).
+const (
+	scopeLinkLocal = 2
+	scopeSiteLocal = 5
+	scopeGlobal    = 14
+)
+
+func addrScope(ip net.IP) int {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return scopeLinkLocal
+	}
+	if ip.IsPrivate() {
+		return scopeSiteLocal
+	}
+	return scopeGlobal
+}
+
+// commonPrefixLen returns the number of leading bits shared by a and b,
+// for RFC 6724 rule 9 (longest matching prefix). Addresses of different
+// families share no prefix.
+func commonPrefixLen(a, b net.IP) int {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil && b4 != nil {
+		return commonPrefixLenBytes(a4, b4)
+	}
+	if a16, b16 := a.To16(), b.To16(); a16 != nil && b16 != nil && a.To4() == nil && b.To4() == nil {
+		return commonPrefixLenBytes(a16, b16)
+	}
+	return 0
+}
+
+func commonPrefixLenBytes(a, b []byte) int {
+	n := 0
+	for i := 0; i < len(a) && i < len(b); i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	return n
+}
+
+func sameFamily(a, b net.IP) bool {
+	return (a.To4() != nil) == (b.To4() != nil)
+}
+
+// sortAddresses orders addrs by preference for connecting from src (which
+// may be nil, meaning "let the system pick"), implementing the subset of
+// RFC 6724's destination address selection that's relevant to chasquid:
+// prefer the address family matching a configured outgoing source address
+// (rule 1), then prefer a scope matching src's (rule 2), then the broadest
+// scope, then the longest matching prefix with src (rule 9). The full algorithm also considers
+// things like multiple candidate source addresses and a configurable
+// policy table, which don't apply here since chasquid has at most one
+// configured outgoing source address.
+func sortAddresses(addrs []net.IP, src net.IP) []net.IP {
+	sorted := make([]net.IP, len(addrs))
+	copy(sorted, addrs)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+
+		if src != nil {
+			if aMatch, bMatch := sameFamily(a, src), sameFamily(b, src); aMatch != bMatch {
+				return aMatch
+			}
+		}
+
+		if src != nil {
+			ss := addrScope(src)
+			if aMatch, bMatch := addrScope(a) == ss, addrScope(b) == ss; aMatch != bMatch {
+				return aMatch
+			}
+		}
+
+		// Otherwise, prefer the broadest (most globally reachable) scope: a
+		// link-local or site-local address is rarely reachable from
+		// wherever we're connecting from, so it shouldn't outrank a
+		// global one.
+		if sa, sb := addrScope(a), addrScope(b); sa != sb {
+			return sa > sb
+		}
+
+		if src != nil {
+			return commonPrefixLen(a, src) > commonPrefixLen(b, src)
+		}
+
+		return false
+	})
+
+	return sorted
+}
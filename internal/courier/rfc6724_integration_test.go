@@ -0,0 +1,58 @@
+package courier
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/testlib"
+)
+
+// TestSMTPMultihomedFallback checks that deliverToHost falls back to the
+// next address of a multi-homed host when the first (best-ranked, per RFC
+// 6724) address refuses the connection, instead of giving up on the MX
+// entirely.
+func TestSMTPMultihomedFallback(t *testing.T) {
+	smtpTotalTimeout = 5 * time.Second
+
+	responses := makeResp(
+		"_welcome", "220 welcome\n",
+		"EHLO hello", "250 ehlo ok\n",
+		"MAIL FROM:<me@me>", "250 mail ok\n",
+		"RCPT TO:<to@to>", "250 rcpt ok\n",
+		"DATA", "354 send data\n",
+		"_DATA", "250 data ok\n",
+		"QUIT", "250 quit ok\n",
+	)
+	srv := newFakeServer(t, responses)
+	_, p, _ := net.SplitHostPort(srv.addr)
+	*smtpPort = p
+
+	// Nothing listens on 127.0.0.2 (the fake server is bound to 127.0.0.1
+	// only), so connecting to it on the server's port is refused right
+	// away, and the test doesn't hang waiting on a timeout.
+	deadAddr := net.ParseIP("127.0.0.2")
+
+	testMX["to"] = []*net.MX{{Host: "multihomed.example.com", Pref: 10}}
+
+	origLookupIP := netLookupIP
+	netLookupIP = func(host string) ([]net.IP, error) {
+		if host != "multihomed.example.com" {
+			return nil, net.UnknownNetworkError("no such host")
+		}
+		// The dead address sorts first (arbitrary order from "DNS"); the
+		// real server's address must still be tried and succeed.
+		return []net.IP{deadAddr, net.ParseIP("127.0.0.1")}, nil
+	}
+	defer func() { netLookupIP = origLookupIP }()
+
+	s, tmpDir := newSMTP(t)
+	defer testlib.RemoveIfOk(t, tmpDir)
+
+	err2, _, _ := s.Deliver("me@me", "to@to", []byte("data"), false)
+	if err2 != nil {
+		t.Errorf("deliver failed, expected fallback to the second address to succeed: %v", err2)
+	}
+
+	srv.wg.Wait()
+}
@@ -0,0 +1,67 @@
+package courier
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSortAddressesFamilyPreference(t *testing.T) {
+	addrs := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}
+
+	got := sortAddresses(addrs, net.ParseIP("192.0.2.100"))
+	if got[0].String() != "192.0.2.1" {
+		t.Errorf("expected IPv4 address to be preferred to match source family, got %v", got)
+	}
+
+	got = sortAddresses(addrs, net.ParseIP("2001:db8::100"))
+	if got[0].String() != "2001:db8::1" {
+		t.Errorf("expected IPv6 address to be preferred to match source family, got %v", got)
+	}
+}
+
+func TestSortAddressesScopePreference(t *testing.T) {
+	addrs := []net.IP{net.ParseIP("169.254.1.1"), net.ParseIP("203.0.113.1")}
+
+	got := sortAddresses(addrs, nil)
+	if got[0].String() != "203.0.113.1" {
+		t.Errorf("expected global-scope address to be preferred over link-local, got %v", got)
+	}
+}
+
+func TestSortAddressesLongestPrefix(t *testing.T) {
+	addrs := []net.IP{net.ParseIP("203.0.113.1"), net.ParseIP("198.51.100.1")}
+	src := net.ParseIP("198.51.100.200")
+
+	got := sortAddresses(addrs, src)
+	if got[0].String() != "198.51.100.1" {
+		t.Errorf("expected address with longer matching prefix to src to be preferred, got %v", got)
+	}
+}
+
+func TestSortAddressesNoSource(t *testing.T) {
+	addrs := []net.IP{net.ParseIP("203.0.113.1"), net.ParseIP("198.51.100.1")}
+
+	got := sortAddresses(addrs, nil)
+	if len(got) != 2 || got[0].String() != "203.0.113.1" {
+		t.Errorf("expected stable order without a source address, got %v", got)
+	}
+}
+
+func TestCommonPrefixLen(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"192.0.2.1", "192.0.2.2", 30},
+		{"192.0.2.1", "203.0.113.1", 4},
+		{"2001:db8::1", "2001:db8::2", 126},
+		{"192.0.2.1", "2001:db8::1", 0},
+	}
+
+	for _, c := range cases {
+		got := commonPrefixLen(net.ParseIP(c.a), net.ParseIP(c.b))
+		if got != c.want {
+			t.Errorf("commonPrefixLen(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
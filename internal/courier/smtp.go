@@ -0,0 +1,685 @@
+package courier
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/idna"
+
+	"blitiri.com.ar/go/chasquid/internal/dnscache"
+	"blitiri.com.ar/go/chasquid/internal/domaininfo"
+	"blitiri.com.ar/go/chasquid/internal/mtasts"
+	"blitiri.com.ar/go/chasquid/internal/trace"
+)
+
+var (
+	// smtpPort overrides the destination port used for outgoing SMTP
+	// connections. It exists so tests can point us at a local fake server;
+	// in production it is left empty, and we use the standard port 25.
+	smtpPort = flag.String("testing___outgoing_smtp_port", "",
+		"port to use for outgoing SMTP connections, for testing purposes only")
+
+	// smtpTotalTimeout bounds the whole delivery attempt to a single MX,
+	// from connection to QUIT.
+	smtpTotalTimeout = 10 * time.Minute
+
+	// mxCache caches MX lookups (including negative ones), so repeated
+	// deliveries to the same domain don't each pay for a fresh DNS round
+	// trip.
+	mxCache = dnscache.New(mxCacheCapacity, dnscache.DefaultPositiveTTL, dnscache.DefaultNegativeTTL)
+
+	// netLookupMX is a variable so tests can override it; in production
+	// it goes through mxCache before falling back to an actual lookup.
+	netLookupMX = func(domain string) ([]*net.MX, error) {
+		return mxCache.LookupMX(domain, net.LookupMX)
+	}
+)
+
+// mxCacheCapacity bounds how many domains' MX lookups we keep cached.
+const mxCacheCapacity = 10000
+
+// maxMXsToTry caps how many MX hosts we will attempt to deliver to, to
+// protect against abuse via domains with abnormally long MX lists.
+const maxMXsToTry = 5
+
+// SMTP delivers mail to remote domains directly, over SMTP, following the
+// domain's MX records.
+type SMTP struct {
+	// Hostname to use in the EHLO/HELO greeting.
+	Hostname string
+
+	// Database used to track what we know about remote domains (e.g.
+	// whether they support TLS).
+	DomainInfoDB *domaininfo.DB
+
+	// Custom dial function, for testing purposes. If nil, net.Dial is
+	// used.
+	Dial func(network, addr string) (net.Conn, error)
+
+	// Smart-host / relay authentication settings, consulted before
+	// falling back to normal MX-based delivery.
+	AuthConfig AuthConfig
+
+	// MTASTSDB caches MTA-STS (RFC 8461) policies. If nil, MTA-STS is not
+	// consulted at all.
+	MTASTSDB *mtasts.DB
+
+	// SourceIP, if set, is the local address outgoing connections are
+	// bound to (the "outgoing_source_ip" configuration option), and also
+	// guides which of a multi-homed MX host's addresses we connect to,
+	// per RFC 6724.
+	SourceIP net.IP
+}
+
+// Deliver the given mail to the given recipient, trying each of the
+// domain's MX servers in turn. requireTLS indicates that the message
+// carries a "require TLS" flag (RFC 8689 REQUIRETLS), set by the queue
+// based on what the original submission requested.
+func (s *SMTP) Deliver(from, to string, data []byte, requireTLS bool) (error, bool, []string) {
+	tr := trace.New("Courier.smtp", to)
+	defer tr.Finish()
+
+	domain, err := domainOf(to)
+	if err != nil {
+		return tr.Errorf("invalid recipient %q: %v", to, err), true, nil
+	}
+
+	// A per-domain pinned policy overrides the message-level flag, so
+	// operators can require TLS for known correspondents even if a
+	// particular message didn't ask for it.
+	if s.DomainInfoDB != nil && s.DomainInfoDB.RequireTLS(domain) {
+		requireTLS = true
+	}
+
+	// If a smart host is configured for this domain (or as a catch-all),
+	// relay through it directly, before even considering the domain's MX
+	// records.
+	if sh, ok := s.AuthConfig.authLookup(domain); ok {
+		exts, err, permanent := s.deliverToHost(tr, domain, sh.Addr, from, to, data, requireTLS, false, sh)
+		return err, permanent, exts
+	}
+
+	mxs, err, permanent := lookupMXs(tr, domain)
+	if err != nil {
+		return err, permanent, nil
+	}
+
+	// An MTA-STS policy in "enforce" mode restricts delivery to its listed
+	// MX hosts, over verified TLS. "testing" mode never restricts or
+	// requires anything, since we don't implement TLSRPT failure
+	// reporting; we only log when none of the domain's MX hosts match the
+	// policy (TLS is not checked against it in this mode), so an operator
+	// watching the logs can gauge the impact before switching the domain
+	// to "enforce".
+	stsEnforced := false
+	if s.MTASTSDB != nil {
+		if policy, perr := s.MTASTSDB.Get(domain); perr == nil {
+			var allowed []string
+			for _, mx := range mxs {
+				if policy.Matches(mx) {
+					allowed = append(allowed, mx)
+				}
+			}
+
+			switch policy.Mode {
+			case mtasts.ModeEnforce:
+				if len(allowed) == 0 {
+					return tr.Errorf(
+						"MTA-STS 550 5.7.1 no MX host for %q matches the enforced policy", domain), true, nil
+				}
+				mxs, stsEnforced = allowed, true
+			case mtasts.ModeTesting:
+				if len(allowed) == 0 {
+					tr.Debugf(
+						"MTA-STS testing: no MX host for %q matches the policy; would bounce in enforce mode, delivering anyway", domain)
+				}
+			}
+		}
+	}
+
+	var lastErr error
+	lastPermanent := true
+	var lastExts []string
+
+	for _, mx := range mxs {
+		exts, err, permanent := s.deliverToHost(tr, domain, mx, from, to, data, requireTLS, stsEnforced, nil)
+		if err == nil {
+			tr.Debugf("delivered via %q", mx)
+			return nil, true, exts
+		}
+
+		tr.Debugf("delivery via %q failed: %v (permanent=%v)", mx, err, permanent)
+		lastErr, lastPermanent, lastExts = err, permanent, exts
+	}
+
+	return lastErr, lastPermanent, lastExts
+}
+
+// domainOf extracts the domain part of an address. The domain is not
+// validated here; lookupMXs does that as part of the ASCII conversion.
+func domainOf(addr string) (string, error) {
+	idx := strings.LastIndex(addr, "@")
+	if idx < 0 {
+		return "", fmt.Errorf("address has no domain")
+	}
+	return addr[idx+1:], nil
+}
+
+// lookupMXs returns the list of MX hosts to try for domain, in preference
+// order, following RFC 5321's fallback rules. The returned boolean
+// indicates whether a failure in using these results (or the lookup
+// itself) should be considered permanent.
+func lookupMXs(tr *trace.Trace, domain string) (mxs []string, err error, permanent bool) {
+	asciiDomain, err := idna.ToASCII(domain)
+	if err != nil {
+		return nil, tr.Errorf("error converting domain to ASCII: %v", err), true
+	}
+
+	mxRecords, err := netLookupMX(asciiDomain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok {
+			if dnsErr.IsTemporary {
+				return nil, err, false
+			}
+
+			// No MX records found: fall back to using the domain itself,
+			// as mandated by RFC 5321 section 5.1.
+			return []string{asciiDomain}, nil, true
+		}
+
+		// Unrecognized error: be conservative and treat it as permanent.
+		return nil, err, true
+	}
+
+	if len(mxRecords) == 0 {
+		return []string{asciiDomain}, nil, true
+	}
+
+	sort.Slice(mxRecords, func(i, j int) bool {
+		return mxRecords[i].Pref < mxRecords[j].Pref
+	})
+
+	if len(mxRecords) > maxMXsToTry {
+		mxRecords = mxRecords[:maxMXsToTry]
+	}
+
+	for _, mx := range mxRecords {
+		mxs = append(mxs, strings.TrimSuffix(mx.Host, "."))
+	}
+
+	return mxs, nil, true
+}
+
+// checkDANE looks up the TLSA records for host:port, and decides whether
+// they should be trusted this time around. If DomainInfoDB previously saw
+// TLSA records for domain but none are found now, that's treated as a
+// possible downgrade attack and fails permanently, rather than silently
+// falling back to a lower security level.
+func (s *SMTP) checkDANE(domain, host, p string) ([]TLSARecord, error, bool) {
+	records, err := netLookupTLSA(host, p)
+	if err != nil {
+		return nil, fmt.Errorf("DANE TLSA lookup failed: %v", err), false
+	}
+
+	if len(records) == 0 {
+		if s.DomainInfoDB != nil && s.DomainInfoDB.DANESeen(domain) {
+			return nil, fmt.Errorf(
+				"DANE 554 5.7.1 TLSA records for %q disappeared, possible downgrade attack", host), true
+		}
+		return nil, nil, false
+	}
+
+	if s.DomainInfoDB != nil {
+		if err := s.DomainInfoDB.SetDANESeen(domain, true); err != nil {
+			return nil, fmt.Errorf("error persisting DANE state: %v", err), false
+		}
+	}
+	return records, nil, false
+}
+
+// ehlo holds the result of parsing an EHLO response: the set of extension
+// keywords the peer advertised, along with any parameters.
+type ehlo struct {
+	// Extension keyword (e.g. "SIZE") -> parameters (e.g. "35882577").
+	exts map[string]string
+}
+
+func (e *ehlo) has(keyword string) bool {
+	_, ok := e.exts[keyword]
+	return ok
+}
+
+func (e *ehlo) params(keyword string) string {
+	return e.exts[keyword]
+}
+
+// parseEHLO parses the text of a (possibly multi-line) EHLO response.
+func parseEHLO(text string) *ehlo {
+	e := &ehlo{exts: map[string]string{}}
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if i == 0 {
+			// The first line is the greeting, not an extension.
+			continue
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		keyword := strings.ToUpper(fields[0])
+		params := ""
+		if len(fields) > 1 {
+			params = fields[1]
+		}
+		e.exts[keyword] = params
+	}
+
+	return e
+}
+
+func dial(network, addr string, sourceIP net.IP, fn func(network, addr string) (net.Conn, error)) (net.Conn, error) {
+	if fn != nil {
+		return fn(network, addr)
+	}
+	d := &net.Dialer{}
+	if sourceIP != nil {
+		d.LocalAddr = &net.TCPAddr{IP: sourceIP}
+	}
+	return d.Dial(network, addr)
+}
+
+// ehlo sends the EHLO greeting and parses the resulting extension list.
+func (s *SMTP) ehlo(tc *textproto.Conn) (*ehlo, error, bool) {
+	id, err := tc.Cmd("EHLO %s", s.Hostname)
+	if err != nil {
+		return nil, fmt.Errorf("error sending EHLO: %v", err), false
+	}
+	tc.StartResponse(id)
+	_, ehloText, err := tc.ReadResponse(250)
+	tc.EndResponse(id)
+	if err != nil {
+		return nil, fmt.Errorf("EHLO %v", err), isPermanent(err)
+	}
+	return parseEHLO(ehloText), nil, false
+}
+
+// startTLS issues STARTTLS and upgrades conn to TLS. When verify is set,
+// the peer certificate is PKIX-verified against host (using rootCAs, or
+// the system roots if rootCAs is nil), so we never complete a delivery
+// that required verified TLS (REQUIRETLS, a configured smart host, or an
+// enforced MTA-STS policy) over an unauthenticated session, and failing to
+// do so is permanent: retrying won't change the operator's or the
+// message's requirements. Otherwise, verification is skipped, matching
+// chasquid's usual opportunistic STARTTLS behaviour (some TLS is much
+// better than none, even if we can't validate who we're talking to). If
+// dane is non-empty, PKIX verification is skipped in favour of matching
+// the peer certificate against the TLSA records instead, as required by
+// RFC 7672; a DANE-only failure (no other reason demanded verified TLS)
+// is transient, since it may be a transient TLSA key-rotation mismatch or
+// a host that temporarily dropped STARTTLS, and the next MX or a later
+// retry may well succeed.
+func startTLS(tc *textproto.Conn, conn net.Conn, host string, verify bool, dane []TLSARecord, rootCAs *x509.CertPool) (net.Conn, error, bool) {
+	id, err := tc.Cmd("STARTTLS")
+	if err != nil {
+		return nil, fmt.Errorf("error sending STARTTLS: %v", err), false
+	}
+	tc.StartResponse(id)
+	_, _, err = tc.ReadResponse(220)
+	tc.EndResponse(id)
+	if err != nil {
+		return nil, fmt.Errorf("STARTTLS %v", err), isPermanent(err)
+	}
+
+	useDANE := len(dane) > 0
+	cfg := &tls.Config{
+		ServerName:         host,
+		RootCAs:            rootCAs,
+		InsecureSkipVerify: !verify || useDANE,
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		if verify {
+			return nil, fmt.Errorf(
+				"REQUIRETLS 554 5.7.1 TLS handshake failed, refusing untrusted session: %v", err), true
+		}
+		if useDANE {
+			return nil, fmt.Errorf(
+				"DANE TLS handshake failed, refusing untrusted session: %v", err), false
+		}
+		return nil, fmt.Errorf("TLS handshake failed: %v", err), false
+	}
+
+	if useDANE {
+		if err := matchDANE(dane, tlsConn.ConnectionState()); err != nil {
+			return nil, fmt.Errorf("DANE 554 5.7.1 %v", err), verify
+		}
+	}
+
+	return tlsConn, nil, false
+}
+
+// deliverToHost attempts delivery of a single message to a single MX (or
+// smart host) host. It returns the list of SMTP extensions that were used
+// during the attempt, for logging and testing purposes. sh is non-nil
+// when relaying through a configured smart host, in which case host is
+// its "host:port" address and SASL authentication is performed after
+// STARTTLS. stsEnforced means an MTA-STS policy in "enforce" mode picked
+// this host, so TLS with a verified peer certificate is mandatory.
+func (s *SMTP) deliverToHost(tr *trace.Trace, domain, host, from, to string, data []byte, requireTLS, stsEnforced bool, sh *SmartHost) (exts []string, err error, permanent bool) {
+	addr := host
+	tlsServerName := host
+	hostPort := port()
+	if sh == nil {
+		addr = net.JoinHostPort(host, hostPort)
+	} else if h, p, splitErr := net.SplitHostPort(host); splitErr == nil {
+		tlsServerName = h
+		hostPort = p
+	}
+
+	// Resolve the host explicitly (rather than letting net.Dial do it),
+	// so we can apply RFC 6724 address selection: with a configured
+	// source address, a multi-homed host's addresses are tried in the
+	// order that best matches it, instead of whatever order the resolver
+	// happened to return. We try them in that order until one connects,
+	// so a single unreachable address on a multi-homed host doesn't cost
+	// us the whole MX.
+	addrs := []string{addr}
+	if ips, ipErr := netLookupIP(tlsServerName); ipErr == nil && len(ips) > 0 {
+		sorted := sortAddresses(ips, s.SourceIP)
+		addrs = make([]string, len(sorted))
+		for i, ip := range sorted {
+			addrs[i] = net.JoinHostPort(ip.String(), hostPort)
+		}
+	}
+
+	// DANE only applies to direct MX delivery: a configured smart host is
+	// an operator-trusted relay, not something looked up via the
+	// recipient domain's own DNS.
+	var dane []TLSARecord
+	if sh == nil {
+		dane, err, permanent = s.checkDANE(domain, tlsServerName, port())
+		if err != nil {
+			return nil, err, permanent
+		}
+	}
+
+	// Credentials must never be sent over an unencrypted connection, and
+	// neither must a connection DANE or an enforced MTA-STS policy
+	// requires us to authenticate. A smart host's certificate must also
+	// be verified: we're about to send it the SASL credentials, and an
+	// unverified TLS session doesn't stop an on-path attacker from
+	// presenting their own cert and harvesting them.
+	mandatoryTLS := requireTLS || sh != nil || len(dane) > 0 || stsEnforced
+	verifyTLS := requireTLS || sh != nil || stsEnforced
+
+	deadline := time.Now().Add(smtpTotalTimeout)
+
+	var conn net.Conn
+	var dialErr error
+	for _, a := range addrs {
+		addr = a
+		conn, dialErr = dial("tcp", a, s.SourceIP, s.Dial)
+		if dialErr == nil {
+			break
+		}
+		tr.Debugf("could not connect to %q: %v", a, dialErr)
+	}
+	if dialErr != nil {
+		return nil, fmt.Errorf("could not connect to %q: %v", addr, dialErr), true
+	}
+	defer func() { conn.Close() }()
+	conn.SetDeadline(deadline)
+
+	tc := textproto.NewConn(conn)
+
+	// Read the welcome banner.
+	if _, _, err := tc.ReadResponse(220); err != nil {
+		return nil, fmt.Errorf("error reading greeting: %v", err), false
+	}
+
+	e, err, permanent := s.ehlo(tc)
+	if err != nil {
+		return nil, err, permanent
+	}
+
+	var rootCAs *x509.CertPool
+	if sh != nil {
+		rootCAs = sh.RootCAs
+	}
+	if e.has("STARTTLS") {
+		tlsConn, sErr, sPermanent := startTLS(tc, conn, tlsServerName, verifyTLS, dane, rootCAs)
+		if sErr != nil {
+			return exts, sErr, sPermanent
+		}
+		exts = append(exts, "STARTTLS")
+		if len(dane) > 0 {
+			exts = append(exts, "DANE")
+		}
+		if stsEnforced {
+			exts = append(exts, "MTA-STS")
+		}
+
+		// RFC 3207 mandates discarding any EHLO state gathered before
+		// STARTTLS, and re-issuing EHLO over the encrypted channel.
+		conn = tlsConn
+		tc = textproto.NewConn(conn)
+		e, err, permanent = s.ehlo(tc)
+		if err != nil {
+			return exts, err, permanent
+		}
+	} else if mandatoryTLS {
+		// We must not fall back to plaintext when TLS was required, nor
+		// send smart-host credentials unencrypted.
+		if !verifyTLS {
+			// Only DANE demanded TLS, so this is transient (see startTLS).
+			return exts, fmt.Errorf(
+				"DANE TLS required but peer does not support STARTTLS"), false
+		}
+		return exts, fmt.Errorf(
+			"REQUIRETLS 554 5.7.1 TLS required but peer does not support STARTTLS"), true
+	}
+
+	if sh != nil {
+		if err, permanent := auth(tc, e, sh); err != nil {
+			return exts, err, permanent
+		}
+		exts = append(exts, "AUTH")
+	}
+
+	var mailParams []string
+
+	if requireTLS && e.has("REQUIRETLS") {
+		exts = append(exts, "REQUIRETLS")
+		mailParams = append(mailParams, "REQUIRETLS")
+	}
+
+	if e.has("SIZE") {
+		exts = append(exts, "SIZE")
+		if limit, perr := strconv.Atoi(e.params("SIZE")); perr == nil && limit > 0 {
+			if len(data) > limit {
+				return exts, fmt.Errorf(
+					"message size %d exceeds server limit %d", len(data), limit), true
+			}
+		}
+		mailParams = append(mailParams, fmt.Sprintf("SIZE=%d", len(data)))
+	}
+
+	if has8bit(data) {
+		if e.has("8BITMIME") {
+			exts = append(exts, "8BITMIME")
+			mailParams = append(mailParams, "BODY=8BITMIME")
+		} else {
+			return exts, fmt.Errorf(
+				"message has 8-bit content, but peer does not support 8BITMIME"), true
+		}
+	}
+
+	if needsUTF8(from) || needsUTF8(to) {
+		if !e.has("SMTPUTF8") {
+			return exts, fmt.Errorf(
+				"message needs SMTPUTF8, but peer does not support it"), true
+		}
+		exts = append(exts, "SMTPUTF8")
+		mailParams = append(mailParams, "SMTPUTF8")
+	}
+
+	mailCmd := "MAIL FROM:<" + from + ">"
+	if len(mailParams) > 0 {
+		mailCmd += " " + strings.Join(mailParams, " ")
+	}
+	rcptCmd := "RCPT TO:<" + to + ">"
+
+	if e.has("PIPELINING") {
+		exts = append(exts, "PIPELINING")
+		return s.pipelinedSend(tr, tc, exts, mailCmd, rcptCmd, data)
+	}
+
+	if err, permanent := sendCmd(tc, "MAIL+RCPT", mailCmd); err != nil {
+		return exts, err, permanent
+	}
+	if err, permanent := sendCmd(tc, "MAIL+RCPT", rcptCmd); err != nil {
+		return exts, err, permanent
+	}
+
+	if err, permanent := sendData(tc, data); err != nil {
+		return exts, err, permanent
+	}
+
+	// Best effort: we don't care about the result of QUIT.
+	tc.Cmd("QUIT")
+
+	return exts, nil, false
+}
+
+// pipelinedSend sends MAIL FROM, RCPT TO and DATA back to back (without
+// waiting for each response), as allowed by the PIPELINING extension
+// (RFC 2920), and then reads the three responses in order, mapping any
+// failure back to the command (and recipient) that caused it.
+func (s *SMTP) pipelinedSend(tr *trace.Trace, tc *textproto.Conn, exts []string, mailCmd, rcptCmd string, data []byte) ([]string, error, bool) {
+	id := tc.Next()
+	tc.StartRequest(id)
+	err := tc.PrintfLine("%s", mailCmd)
+	if err == nil {
+		err = tc.PrintfLine("%s", rcptCmd)
+	}
+	if err == nil {
+		err = tc.PrintfLine("DATA")
+	}
+	tc.EndRequest(id)
+	if err != nil {
+		return exts, fmt.Errorf("error writing pipelined commands: %v", err), false
+	}
+
+	if _, _, err := tc.ReadResponse(250); err != nil {
+		return exts, fmt.Errorf("MAIL+RCPT %v (in reply to %q)", err, mailCmd), isPermanent(err)
+	}
+	if _, _, err := tc.ReadResponse(250); err != nil {
+		return exts, fmt.Errorf("MAIL+RCPT %v (in reply to %q)", err, rcptCmd), isPermanent(err)
+	}
+	if _, _, err := tc.ReadResponse(354); err != nil {
+		return exts, fmt.Errorf("DATA %v", err), isPermanent(err)
+	}
+
+	if err, permanent := writeData(tc, data); err != nil {
+		return exts, err, permanent
+	}
+
+	tc.Cmd("QUIT")
+	return exts, nil, false
+}
+
+// sendCmd sends cmd, reads the response, and returns an error (prefixed
+// with label) if the response was not 250, along with whether that error
+// should be considered permanent.
+func sendCmd(tc *textproto.Conn, label, cmd string) (error, bool) {
+	id, err := tc.Cmd("%s", cmd)
+	if err != nil {
+		return fmt.Errorf("%s %v", label, err), false
+	}
+	tc.StartResponse(id)
+	defer tc.EndResponse(id)
+	if _, _, err := tc.ReadResponse(250); err != nil {
+		return fmt.Errorf("%s %v", label, err), isPermanent(err)
+	}
+	return nil, false
+}
+
+// sendData sends the DATA command and, if accepted, the message contents.
+func sendData(tc *textproto.Conn, data []byte) (error, bool) {
+	id, err := tc.Cmd("DATA")
+	if err != nil {
+		return fmt.Errorf("DATA %v", err), false
+	}
+	tc.StartResponse(id)
+	_, _, err = tc.ReadResponse(354)
+	tc.EndResponse(id)
+	if err != nil {
+		return fmt.Errorf("DATA %v", err), isPermanent(err)
+	}
+
+	return writeData(tc, data)
+}
+
+// writeData writes the dot-stuffed message body, and reads the final
+// "250"-or-error response that follows the closing ".".
+func writeData(tc *textproto.Conn, data []byte) (error, bool) {
+	dw := tc.DotWriter()
+	if _, err := dw.Write(data); err != nil {
+		dw.Close()
+		return fmt.Errorf("error writing data: %v", err), false
+	}
+	if err := dw.Close(); err != nil {
+		return fmt.Errorf("DATA closing %v", err), isPermanent(err)
+	}
+	if _, _, err := tc.ReadResponse(250); err != nil {
+		return fmt.Errorf("DATA closing %v", err), isPermanent(err)
+	}
+	return nil, false
+}
+
+func port() string {
+	if *smtpPort != "" {
+		return *smtpPort
+	}
+	return "25"
+}
+
+// isPermanent classifies an SMTP-level error as permanent or transient,
+// based on the leading digit of the status code (4xx is transient, 5xx is
+// permanent). Non-SMTP errors (timeouts, connection issues) default to
+// transient, since they may well succeed on a retry.
+func isPermanent(err error) bool {
+	if pe, ok := err.(*textproto.Error); ok {
+		return pe.Code >= 500
+	}
+	return false
+}
+
+func has8bit(data []byte) bool {
+	for _, b := range data {
+		if b >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+func needsUTF8(addr string) bool {
+	for _, r := range addr {
+		if r >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package courier
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is a minimal, scripted SMTP server used to test the courier
+// against canned responses, keyed by the command line that triggers them.
+type fakeServer struct {
+	addr string
+	wg   sync.WaitGroup
+}
+
+// newFakeServer starts a fakeServer that accepts a single connection, and
+// replies to each command line with responses[line]. The special key
+// "_welcome" is used for the initial greeting, and "_DATA" for the
+// response sent after the message body is received.
+func newFakeServer(t *testing.T, responses map[string]string) *fakeServer {
+	return newFakeServerTLS(t, responses, nil)
+}
+
+// newFakeServerTLS is like newFakeServer, but if tlsConfig is not nil, a
+// "STARTTLS" command line (whose response begins with "220") triggers an
+// in-place upgrade of the connection to TLS, after which the rest of the
+// conversation is read from the encrypted channel.
+func newFakeServerTLS(t *testing.T, responses map[string]string, tlsConfig *tls.Config) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	s := &fakeServer{addr: l.Addr().String()}
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+		defer l.Close()
+
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		s.handle(conn, responses, tlsConfig)
+	}()
+
+	return s
+}
+
+func (s *fakeServer) handle(conn net.Conn, responses map[string]string, tlsConfig *tls.Config) {
+	conn.Write([]byte(responses["_welcome"]))
+
+	r := bufio.NewReader(conn)
+	ehloCount := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		// EHLO is sent twice in a STARTTLS conversation (once before, once
+		// after the upgrade); the second lookup uses a "TLS " prefix, so
+		// tests can script different extension lists for each.
+		key := line
+		if strings.HasPrefix(line, "EHLO ") {
+			ehloCount++
+			if ehloCount > 1 {
+				key = "TLS " + line
+			}
+		}
+
+		resp, ok := responses[key]
+		if !ok {
+			conn.Write([]byte("500 unknown command\r\n"))
+			continue
+		}
+		conn.Write([]byte(resp))
+
+		if line == "STARTTLS" && tlsConfig != nil && strings.HasPrefix(resp, "220") {
+			tlsConn := tls.Server(conn, tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			r = bufio.NewReader(conn)
+			continue
+		}
+
+		if line == "DATA" && strings.HasPrefix(resp, "354") {
+			for {
+				dl, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dl == ".\r\n" || dl == ".\n" {
+					break
+				}
+			}
+			conn.Write([]byte(responses["_DATA"]))
+		}
+
+		if line == "QUIT" {
+			return
+		}
+	}
+}
+
+// selfSignedCert generates an ephemeral, self-signed certificate for
+// 127.0.0.1, for use in tests that need to exercise STARTTLS.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// makeResp builds a responses map out of a flat list of key, value pairs,
+// for use in table-driven tests.
+func makeResp(kv ...string) map[string]string {
+	m := map[string]string{}
+	for i := 0; i < len(kv); i += 2 {
+		m[kv[i]] = kv[i+1]
+	}
+	return m
+}
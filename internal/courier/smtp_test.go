@@ -1,6 +1,7 @@
 package courier
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"strings"
@@ -20,10 +21,26 @@ var invalidDomain = "test " + strings.Repeat("x", 65536) + "\uff00"
 var testMX = map[string][]*net.MX{}
 var testMXErr = map[string]error{}
 
+// Override the netLookupTLSA function, to return controlled results for
+// testing (see dane_test.go). Tests that don't care about DANE get no
+// records, as if the domain didn't deploy it.
+var testTLSA = map[string][]TLSARecord{}
+var testTLSAErr = map[string]error{}
+
 func init() {
 	netLookupMX = func(name string) ([]*net.MX, error) {
 		return testMX[name], testMXErr[name]
 	}
+	netLookupTLSA = func(host, port string) ([]TLSARecord, error) {
+		return testTLSA[host], testTLSAErr[host]
+	}
+	// Tests connect to fake servers listening on 127.0.0.1 (or to
+	// deliberately invalid hosts), so there's no real host to resolve; fail
+	// the lookup so deliverToHost falls back to using the host/port string
+	// as-is.
+	netLookupIP = func(host string) ([]net.IP, error) {
+		return nil, fmt.Errorf("no such host")
+	}
 }
 
 func newSMTP(t *testing.T) (*SMTP, string) {
@@ -33,7 +50,7 @@ func newSMTP(t *testing.T) (*SMTP, string) {
 		t.Fatal(err)
 	}
 
-	return &SMTP{"hello", dinfo, nil}, dir
+	return &SMTP{"hello", dinfo, nil, AuthConfig{}, nil, nil}, dir
 }
 
 func TestSMTP(t *testing.T) {
@@ -67,7 +84,7 @@ func TestSMTP(t *testing.T) {
 
 	s, tmpDir := newSMTP(t)
 	defer testlib.RemoveIfOk(t, tmpDir)
-	err, _ := s.Deliver("me@me", "to@to", []byte("data"))
+	err, _, _ := s.Deliver("me@me", "to@to", []byte("data"), false)
 	if err != nil {
 		t.Errorf("deliver failed: %v", err)
 	}
@@ -146,7 +163,7 @@ func TestSMTPErrors(t *testing.T) {
 
 		s, tmpDir := newSMTP(t)
 		defer testlib.RemoveIfOk(t, tmpDir)
-		err, _ := s.Deliver("me@me", "to@to", []byte("data"))
+		err, _, _ := s.Deliver("me@me", "to@to", []byte("data"), false)
 
 		if err == nil {
 			t.Errorf("deliver not failed in case %q: %v",
@@ -169,7 +186,7 @@ func TestNoMXServer(t *testing.T) {
 
 	s, tmpDir := newSMTP(t)
 	defer testlib.RemoveIfOk(t, tmpDir)
-	err, permanent := s.Deliver("me@me", "to@to", []byte("data"))
+	err, permanent, _ := s.Deliver("me@me", "to@to", []byte("data"), false)
 	if err == nil {
 		t.Errorf("delivery worked, expected failure")
 	}
@@ -261,4 +278,156 @@ func TestLookupInvalidDomain(t *testing.T) {
 	}
 }
 
+func TestSMTPExtensions(t *testing.T) {
+	smtpTotalTimeout = 5 * time.Second
+
+	responses := makeResp(
+		"_welcome", "220 welcome\n",
+		"EHLO hello", "250-ehlo ok\r\n250-SIZE 1000000\r\n250-8BITMIME\r\n250-SMTPUTF8\r\n250 PIPELINING\r\n",
+		"MAIL FROM:<me@me> SIZE=4 BODY=8BITMIME", "250 mail ok\n",
+		"RCPT TO:<to@to>", "250 rcpt ok\n",
+		"DATA", "354 send data\n",
+		"_DATA", "250 data ok\n",
+		"QUIT", "250 quit ok\n",
+	)
+	srv := newFakeServer(t, responses)
+	host, port, _ := net.SplitHostPort(srv.addr)
+
+	testMX["to"] = []*net.MX{{Host: host, Pref: 10}}
+	*smtpPort = port
+
+	s, tmpDir := newSMTP(t)
+	defer testlib.RemoveIfOk(t, tmpDir)
+
+	// Use 8-bit data to trigger BODY=8BITMIME.
+	err, _, exts := s.Deliver("me@me", "to@to", []byte{0xc3, 0xa9, 0x21, 0x0a}, false)
+	if err != nil {
+		t.Errorf("deliver failed: %v", err)
+	}
+
+	wantExts := map[string]bool{"SIZE": false, "8BITMIME": false, "PIPELINING": false}
+	for _, e := range exts {
+		if _, ok := wantExts[e]; !ok {
+			t.Errorf("unexpected extension reported: %q", e)
+		}
+		wantExts[e] = true
+	}
+	for e, used := range wantExts {
+		if !used {
+			t.Errorf("expected extension %q to be used, exts=%v", e, exts)
+		}
+	}
+
+	srv.wg.Wait()
+}
+
+func TestSMTPSizeExceeded(t *testing.T) {
+	smtpTotalTimeout = 5 * time.Second
+
+	responses := makeResp(
+		"_welcome", "220 welcome\n",
+		"EHLO hello", "250-ehlo ok\r\n250 SIZE 2\r\n",
+	)
+	srv := newFakeServer(t, responses)
+	host, port, _ := net.SplitHostPort(srv.addr)
+
+	testMX["to"] = []*net.MX{{Host: host, Pref: 10}}
+	*smtpPort = port
+
+	s, tmpDir := newSMTP(t)
+	defer testlib.RemoveIfOk(t, tmpDir)
+
+	err, permanent, _ := s.Deliver("me@me", "to@to", []byte("this message is too big"), false)
+	if err == nil {
+		t.Errorf("deliver worked, expected failure due to SIZE limit")
+	}
+	if !permanent {
+		t.Errorf("expected permanent failure, got transient (%v)", err)
+	}
+}
+
+func TestSMTPRequireTLS(t *testing.T) {
+	smtpTotalTimeout = 5 * time.Second
+	cert := selfSignedCert(t)
+
+	responses := makeResp(
+		"_welcome", "220 welcome\n",
+		"EHLO hello", "250-ehlo ok\r\n250 STARTTLS\r\n",
+		"STARTTLS", "220 go ahead\n",
+		"TLS EHLO hello", "250-ehlo ok\r\n250 PIPELINING\r\n",
+		"MAIL FROM:<me@me>", "250 mail ok\n",
+		"RCPT TO:<to@to>", "250 rcpt ok\n",
+		"DATA", "354 send data\n",
+		"_DATA", "250 data ok\n",
+		"QUIT", "250 quit ok\n",
+	)
+	srv := newFakeServerTLS(t, responses, &tls.Config{Certificates: []tls.Certificate{cert}})
+	host, port, _ := net.SplitHostPort(srv.addr)
+
+	testMX["to"] = []*net.MX{{Host: host, Pref: 10}}
+	*smtpPort = port
+
+	s, tmpDir := newSMTP(t)
+	defer testlib.RemoveIfOk(t, tmpDir)
+
+	// The server's certificate is self-signed, so a REQUIRETLS delivery
+	// (which demands a verified session) must refuse to complete instead
+	// of silently accepting an untrusted peer.
+	err, permanent, _ := s.Deliver("me@me", "to@to", []byte("data"), true)
+	if err == nil {
+		t.Fatalf("delivery worked, expected failure due to untrusted cert")
+	}
+	if !permanent {
+		t.Errorf("expected permanent failure, got transient (%v)", err)
+	}
+	t.Logf("got permanent failure, as expected: %v", err)
+}
+
+func TestSMTPOpportunisticSTARTTLS(t *testing.T) {
+	smtpTotalTimeout = 5 * time.Second
+	cert := selfSignedCert(t)
+
+	responses := makeResp(
+		"_welcome", "220 welcome\n",
+		"EHLO hello", "250-ehlo ok\r\n250 STARTTLS\r\n",
+		"STARTTLS", "220 go ahead\n",
+		"TLS EHLO hello", "250 ehlo ok\n",
+		"MAIL FROM:<me@me>", "250 mail ok\n",
+		"RCPT TO:<to@to>", "250 rcpt ok\n",
+		"DATA", "354 send data\n",
+		"_DATA", "250 data ok\n",
+		"QUIT", "250 quit ok\n",
+	)
+	srv := newFakeServerTLS(t, responses, &tls.Config{Certificates: []tls.Certificate{cert}})
+	host, port, _ := net.SplitHostPort(srv.addr)
+
+	testMX["to"] = []*net.MX{{Host: host, Pref: 10}}
+	*smtpPort = port
+
+	s, tmpDir := newSMTP(t)
+	defer testlib.RemoveIfOk(t, tmpDir)
+
+	// Without REQUIRETLS, we still opportunistically use STARTTLS, but
+	// don't require the certificate to be trusted.
+	err, _, exts := s.Deliver("me@me", "to@to", []byte("data"), false)
+	if err != nil {
+		t.Errorf("deliver failed: %v", err)
+	}
+
+	found := false
+	for _, e := range exts {
+		if e == "STARTTLS" {
+			found = true
+		}
+		if e == "REQUIRETLS" {
+			t.Errorf("REQUIRETLS reported as used, but it wasn't requested")
+		}
+	}
+	if !found {
+		t.Errorf("expected STARTTLS to be used, exts=%v", exts)
+	}
+
+	srv.wg.Wait()
+}
+
 // TODO: Test STARTTLS negotiation.
@@ -0,0 +1,159 @@
+// Package dnscache implements a small in-memory cache for MX lookups,
+// with positive and negative TTLs and LRU eviction, so that delivering to
+// the same domains repeatedly doesn't pay for a fresh DNS round trip each
+// time.
+package dnscache
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPositiveTTL bounds how long a successful MX lookup is
+	// reused. net.LookupMX doesn't expose the record's actual DNS TTL, so
+	// we use a fixed, conservative window instead.
+	DefaultPositiveTTL = 5 * time.Minute
+
+	// DefaultNegativeTTL bounds how long a failed lookup is reused,
+	// shorter than the positive TTL so a domain that starts working again
+	// (e.g. after fixing a DNS outage) isn't penalized for long.
+	DefaultNegativeTTL = 1 * time.Minute
+)
+
+// Stats holds cumulative cache counters, for monitoring.
+type Stats struct {
+	Hits        uint64
+	Misses      uint64
+	Expirations uint64
+	Evictions   uint64
+}
+
+type entry struct {
+	mxs       []*net.MX
+	err       error
+	expiresAt time.Time
+}
+
+type listEntry struct {
+	domain string
+	entry  entry
+}
+
+// Cache is an LRU cache of MX lookups, bounded to capacity entries, safe
+// for concurrent use.
+type Cache struct {
+	mu       sync.RWMutex
+	capacity int
+
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+
+	ll    *list.List
+	items map[string]*list.Element
+
+	stats Stats
+}
+
+// New creates an MX lookup cache holding up to capacity entries (0 means
+// unbounded). positiveTTL and negativeTTL bound how long successful and
+// failed lookups are reused, respectively; DefaultPositiveTTL and
+// DefaultNegativeTTL are reasonable defaults for callers that don't need
+// to tune them.
+func New(capacity int, positiveTTL, negativeTTL time.Duration) *Cache {
+	return &Cache{
+		capacity:    capacity,
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+		ll:          list.New(),
+		items:       map[string]*list.Element{},
+	}
+}
+
+// LookupMX returns the cached MX lookup result for domain, if present and
+// unexpired; otherwise it calls fetch, caches the result (using the
+// positive or negative TTL as appropriate), and returns it.
+func (c *Cache) LookupMX(domain string, fetch func(string) ([]*net.MX, error)) ([]*net.MX, error) {
+	if e, ok := c.get(domain); ok {
+		return copyMXs(e.mxs), e.err
+	}
+
+	mxs, err := fetch(domain)
+
+	ttl := c.positiveTTL
+	if err != nil {
+		ttl = c.negativeTTL
+	}
+	c.put(domain, entry{mxs: mxs, err: err, expiresAt: time.Now().Add(ttl)})
+
+	return copyMXs(mxs), err
+}
+
+// copyMXs returns a fresh copy of mxs, so callers that reorder or
+// truncate the slice they get back (e.g. lookupMXs sorting by
+// preference) don't race with other callers sharing the same cache
+// entry.
+func copyMXs(mxs []*net.MX) []*net.MX {
+	if mxs == nil {
+		return nil
+	}
+	cp := make([]*net.MX, len(mxs))
+	copy(cp, mxs)
+	return cp
+}
+
+func (c *Cache) get(domain string) (entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[domain]
+	if !ok {
+		c.stats.Misses++
+		return entry{}, false
+	}
+
+	le := el.Value.(*listEntry)
+	if time.Now().After(le.entry.expiresAt) {
+		c.stats.Expirations++
+		c.ll.Remove(el)
+		delete(c.items, domain)
+		return entry{}, false
+	}
+
+	c.ll.MoveToFront(el)
+	c.stats.Hits++
+	return le.entry, true
+}
+
+func (c *Cache) put(domain string, e entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[domain]; ok {
+		el.Value.(*listEntry).entry = e
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	el := c.ll.PushFront(&listEntry{domain: domain, entry: e})
+	c.items[domain] = el
+
+	if c.capacity > 0 && c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*listEntry).domain)
+			c.stats.Evictions++
+		}
+	}
+}
+
+// Stats returns a snapshot of the cache's cumulative hit/miss/eviction
+// counters.
+func (c *Cache) Stats() Stats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.stats
+}
@@ -0,0 +1,128 @@
+package dnscache
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCacheHitMiss(t *testing.T) {
+	c := New(10, DefaultPositiveTTL, DefaultNegativeTTL)
+
+	calls := 0
+	fetch := func(domain string) ([]*net.MX, error) {
+		calls++
+		return []*net.MX{{Host: domain, Pref: 10}}, nil
+	}
+
+	if _, err := c.LookupMX("a.com", fetch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := c.LookupMX("a.com", fetch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if calls != 1 {
+		t.Errorf("expected fetch to be called once, got %d", calls)
+	}
+
+	stats := c.Stats()
+	if stats.Misses != 1 || stats.Hits != 1 {
+		t.Errorf("expected 1 miss and 1 hit, got %+v", stats)
+	}
+}
+
+func TestCacheNegativeCaching(t *testing.T) {
+	c := New(10, DefaultPositiveTTL, DefaultNegativeTTL)
+
+	calls := 0
+	wantErr := fmt.Errorf("no such domain")
+	fetch := func(domain string) ([]*net.MX, error) {
+		calls++
+		return nil, wantErr
+	}
+
+	if _, err := c.LookupMX("bad.com", fetch); err != wantErr {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := c.LookupMX("bad.com", fetch); err != wantErr {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if calls != 1 {
+		t.Errorf("expected fetch to be called once, got %d", calls)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := New(10, 10*time.Millisecond, DefaultNegativeTTL)
+
+	calls := 0
+	fetch := func(domain string) ([]*net.MX, error) {
+		calls++
+		return []*net.MX{{Host: domain, Pref: 10}}, nil
+	}
+
+	if _, err := c.LookupMX("a.com", fetch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := c.LookupMX("a.com", fetch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if calls != 2 {
+		t.Errorf("expected fetch to be called twice after expiry, got %d", calls)
+	}
+	if c.Stats().Expirations != 1 {
+		t.Errorf("expected 1 expiration, got %+v", c.Stats())
+	}
+}
+
+func TestCacheLRUEviction(t *testing.T) {
+	c := New(2, DefaultPositiveTTL, DefaultNegativeTTL)
+
+	fetch := func(domain string) ([]*net.MX, error) {
+		return []*net.MX{{Host: domain, Pref: 10}}, nil
+	}
+
+	c.LookupMX("a.com", fetch)
+	c.LookupMX("b.com", fetch)
+	c.LookupMX("c.com", fetch) // evicts a.com, the least recently used
+
+	calls := 0
+	countingFetch := func(domain string) ([]*net.MX, error) {
+		calls++
+		return []*net.MX{{Host: domain, Pref: 10}}, nil
+	}
+
+	c.LookupMX("a.com", countingFetch)
+	if calls != 1 {
+		t.Errorf("expected a.com to have been evicted and re-fetched, got %d calls", calls)
+	}
+	// The first eviction was a.com (above); re-inserting it into the
+	// already-full 2-entry cache evicts b.com, the now-least-recently-used
+	// entry, for a second eviction.
+	if c.Stats().Evictions != 2 {
+		t.Errorf("expected 2 evictions, got %+v", c.Stats())
+	}
+}
+
+func TestCacheReturnsIndependentSlice(t *testing.T) {
+	c := New(10, DefaultPositiveTTL, DefaultNegativeTTL)
+	fetch := func(domain string) ([]*net.MX, error) {
+		return []*net.MX{{Host: "x", Pref: 1}, {Host: "y", Pref: 2}}, nil
+	}
+
+	mxs1, _ := c.LookupMX("a.com", fetch)
+	mxs2, _ := c.LookupMX("a.com", fetch)
+
+	mxs1[0], mxs1[1] = mxs1[1], mxs1[0]
+
+	if mxs2[0].Host != "x" {
+		t.Errorf("mutating one caller's slice affected another's: %v", mxs2)
+	}
+}
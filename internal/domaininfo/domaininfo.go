@@ -0,0 +1,138 @@
+// Package domaininfo implements a small persistent database of what we
+// know about remote domains, so the courier can make delivery decisions
+// that are consistent across restarts (e.g. not regressing TLS security
+// once we've seen a domain support it).
+package domaininfo
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// record holds what we know about a single remote domain.
+type record struct {
+	// RequireTLS pins mandatory, verified TLS for outgoing mail to this
+	// domain, regardless of what the message or the remote server ask
+	// for. This lets operators protect known correspondents even when
+	// the messages themselves don't carry a REQUIRETLS flag.
+	RequireTLS bool
+
+	// DANESeen records whether we've previously found valid DANE TLSA
+	// records for this domain. Once true, a later delivery that finds no
+	// TLSA records at all is treated with suspicion (the records may have
+	// been stripped by an on-path attacker) rather than silently falling
+	// back to a lower security level.
+	DANESeen bool
+}
+
+// DB is a persistent, in-memory-cached database of per-domain records. It
+// is safe for concurrent use.
+type DB struct {
+	mu      sync.Mutex
+	dir     string
+	records map[string]*record
+}
+
+// New creates (or loads) a domain info database rooted at dir.
+func New(dir string) (*DB, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	db := &DB{dir: dir, records: map[string]*record{}}
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *DB) dbPath() string {
+	return filepath.Join(db.dir, "domaininfo.gob")
+}
+
+func (db *DB) load() error {
+	f, err := os.Open(db.dbPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return gob.NewDecoder(f).Decode(&db.records)
+}
+
+// save persists the database to disk. Callers must hold db.mu.
+func (db *DB) save() error {
+	f, err := os.Create(db.dbPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return gob.NewEncoder(f).Encode(db.records)
+}
+
+// get returns the record for domain, or a zero-value record if none is
+// known. Unlike getOrCreate, it never adds an entry to db.records, so
+// merely querying a domain we've never sent mail to (e.g. a RequireTLS
+// check) doesn't grow the database. Callers must hold db.mu.
+func (db *DB) get(domain string) record {
+	if r, ok := db.records[domain]; ok {
+		return *r
+	}
+	return record{}
+}
+
+// getOrCreate returns the record for domain, creating it if needed.
+// Callers must hold db.mu.
+func (db *DB) getOrCreate(domain string) *record {
+	r, ok := db.records[domain]
+	if !ok {
+		r = &record{}
+		db.records[domain] = r
+	}
+	return r
+}
+
+// RequireTLS reports whether TLS is pinned as mandatory for domain,
+// regardless of per-message flags.
+func (db *DB) RequireTLS(domain string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.get(domain).RequireTLS
+}
+
+// SetRequireTLS pins (or unpins) mandatory TLS for domain, and persists
+// the change to disk.
+func (db *DB) SetRequireTLS(domain string, require bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.getOrCreate(domain).RequireTLS = require
+	return db.save()
+}
+
+// DANESeen reports whether we've previously found valid DANE TLSA records
+// for domain.
+func (db *DB) DANESeen(domain string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.get(domain).DANESeen
+}
+
+// SetDANESeen records whether domain has DANE TLSA records, and persists
+// the change to disk. It is never reset back to false automatically: once
+// a domain deploys DANE, disappearing records are treated as suspicious
+// rather than as the domain opting back out.
+func (db *DB) SetDANESeen(domain string, seen bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if seen {
+		db.getOrCreate(domain).DANESeen = true
+	}
+	return db.save()
+}
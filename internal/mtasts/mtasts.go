@@ -0,0 +1,287 @@
+// Package mtasts implements fetching, caching and parsing of MTA-STS
+// policies (RFC 8461), so the courier can decide whether a destination
+// domain requires TLS delivery to one of a known set of MX hosts.
+package mtasts
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mode is a policy's enforcement level, as published by the domain.
+type Mode string
+
+const (
+	// ModeEnforce means delivery must use TLS to one of the listed MX
+	// hosts, refusing otherwise.
+	ModeEnforce Mode = "enforce"
+
+	// ModeTesting means the domain is still validating its policy: we
+	// fetch and cache it, but don't refuse delivery on a mismatch.
+	ModeTesting Mode = "testing"
+
+	// ModeNone means the domain has (temporarily) opted out.
+	ModeNone Mode = "none"
+)
+
+// Policy is a parsed MTA-STS policy, as fetched from
+// https://mta-sts.<domain>/.well-known/mta-sts.txt.
+type Policy struct {
+	Mode   Mode
+	MX     []string
+	MaxAge time.Duration
+}
+
+// Matches reports whether host satisfies one of the policy's "mx"
+// patterns, per RFC 8461 section 4.1: either an exact match, or a single
+// leading "*." wildcard label, which matches exactly one label.
+func (p *Policy) Matches(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, pattern := range p.MX {
+		pattern = strings.TrimSuffix(strings.ToLower(pattern), ".")
+		if pattern == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			label, found := strings.CutSuffix(host, "."+suffix)
+			if found && label != "" && !strings.Contains(label, ".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// netLookupTXT and netHTTPGet are variables so tests can fake DNS and
+// HTTP responses, the same way netLookupMX is faked in the courier
+// package.
+var (
+	netLookupTXT = net.LookupTXT
+	netHTTPGet   = http.Get
+)
+
+// entry is what we persist to disk: the policy, the "id" from its TXT
+// record, and when we last fetched it, so we know when MaxAge has elapsed.
+// The stored id is not compared against later TXT lookups: once MaxAge has
+// elapsed, the policy file is fetched again whether or not the id changed.
+type entry struct {
+	Policy    Policy
+	ID        string
+	FetchedAt time.Time
+}
+
+// DB is a persistent, disk-backed cache of MTA-STS policies, structured
+// the same way as domaininfo.DB.
+type DB struct {
+	mu      sync.Mutex
+	dir     string
+	entries map[string]*entry
+}
+
+// New creates (or loads) an MTA-STS policy cache rooted at dir.
+func New(dir string) (*DB, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	db := &DB{dir: dir, entries: map[string]*entry{}}
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *DB) dbPath() string {
+	return filepath.Join(db.dir, "mtasts.gob")
+}
+
+func (db *DB) load() error {
+	f, err := os.Open(db.dbPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return gob.NewDecoder(f).Decode(&db.entries)
+}
+
+// save persists the cache to disk. Callers must hold db.mu.
+func (db *DB) save() error {
+	f, err := os.Create(db.dbPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return gob.NewEncoder(f).Encode(db.entries)
+}
+
+// Get returns the current MTA-STS policy for domain, fetching (and
+// caching) it if we don't have a fresh one. If a fresh fetch fails but we
+// have a previously cached policy, the cached one is returned instead of
+// an error: RFC 8461 section 5.2 recommends continuing to enforce the
+// last known-good policy rather than silently dropping protection because
+// of a transient fetch failure.
+func (db *DB) Get(domain string) (*Policy, error) {
+	db.mu.Lock()
+	e, ok := db.entries[domain]
+	db.mu.Unlock()
+
+	if ok && time.Since(e.FetchedAt) < e.Policy.MaxAge {
+		p := e.Policy
+		return &p, nil
+	}
+
+	policy, id, err := fetch(domain)
+	if err != nil {
+		if ok {
+			p := e.Policy
+			return &p, nil
+		}
+		return nil, err
+	}
+
+	db.mu.Lock()
+	db.entries[domain] = &entry{Policy: *policy, ID: id, FetchedAt: time.Now()}
+	err = db.save()
+	db.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// SetForTesting installs policy as domain's cached policy, without going
+// through an actual DNS/HTTPS fetch, so that other packages' tests (e.g.
+// the courier, which consumes a *DB but has no reason to fake this
+// package's DNS/HTTP lookups) can exercise MTA-STS-aware code paths
+// directly.
+func (db *DB) SetForTesting(domain string, policy *Policy) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.entries[domain] = &entry{Policy: *policy, ID: "testing", FetchedAt: time.Now()}
+}
+
+// fetch retrieves and parses domain's MTA-STS policy: first the
+// "_mta-sts" TXT record (which carries an opaque "id"; its presence is
+// required, but its value doesn't decide whether to fetch), then the policy
+// file itself over HTTPS.
+func fetch(domain string) (*Policy, string, error) {
+	id, err := lookupPolicyID(domain)
+	if err != nil {
+		return nil, "", err
+	}
+
+	url := "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+	resp, err := netHTTPGet(url)
+	if err != nil {
+		return nil, "", fmt.Errorf("error fetching policy: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status fetching policy: %v", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading policy: %v", err)
+	}
+
+	policy, err := parsePolicy(string(body))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return policy, id, nil
+}
+
+// lookupPolicyID finds the "id" tag in domain's "_mta-sts" TXT record, as
+// required by RFC 8461 section 3.
+func lookupPolicyID(domain string) (string, error) {
+	txts, err := netLookupTXT("_mta-sts." + domain)
+	if err != nil {
+		return "", fmt.Errorf("error looking up _mta-sts TXT record: %v", err)
+	}
+
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=STSv1") {
+			continue
+		}
+		for _, field := range strings.Split(txt, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(field), "=")
+			if ok && strings.TrimSpace(k) == "id" {
+				return strings.TrimSpace(v), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no valid _mta-sts TXT record found")
+}
+
+// parsePolicy parses the contents of a mta-sts.txt policy file, per RFC
+// 8461 section 3.2.
+func parsePolicy(text string) (*Policy, error) {
+	p := &Policy{MaxAge: 24 * time.Hour}
+
+	sawVersion := false
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key := strings.TrimSpace(k)
+		val := strings.TrimSpace(v)
+
+		switch key {
+		case "version":
+			if val != "STSv1" {
+				return nil, fmt.Errorf("unsupported policy version %q", val)
+			}
+			sawVersion = true
+		case "mode":
+			p.Mode = Mode(val)
+		case "mx":
+			p.MX = append(p.MX, val)
+		case "max_age":
+			secs, err := strconv.Atoi(val)
+			if err != nil || secs <= 0 {
+				return nil, fmt.Errorf("invalid max_age %q", val)
+			}
+			p.MaxAge = time.Duration(secs) * time.Second
+		}
+	}
+
+	if !sawVersion {
+		return nil, fmt.Errorf("policy is missing the version field")
+	}
+	switch p.Mode {
+	case ModeEnforce, ModeTesting, ModeNone:
+	default:
+		return nil, fmt.Errorf("invalid or missing mode %q", p.Mode)
+	}
+	if p.Mode == ModeEnforce && len(p.MX) == 0 {
+		return nil, fmt.Errorf("enforce policy has no mx entries")
+	}
+
+	return p, nil
+}
@@ -0,0 +1,139 @@
+package mtasts
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/testlib"
+)
+
+func TestPolicyMatches(t *testing.T) {
+	p := &Policy{MX: []string{"mail.example.com", "*.mx.example.com"}}
+
+	cases := []struct {
+		host string
+		want bool
+	}{
+		{"mail.example.com", true},
+		{"MAIL.EXAMPLE.COM", true},
+		{"a.mx.example.com", true},
+		{"mx.example.com", false}, // wildcard covers one label, not the bare domain
+		{"other.example.com", false},
+		{"a.b.mx.example.com", false},
+	}
+
+	for _, c := range cases {
+		if got := p.Matches(c.host); got != c.want {
+			t.Errorf("Matches(%q) = %v, want %v", c.host, got, c.want)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	cases := []struct {
+		text    string
+		wantErr bool
+	}{
+		{
+			"version: STSv1\nmode: enforce\nmx: mail.example.com\nmax_age: 604800\n",
+			false,
+		},
+		{
+			"version: STSv1\nmode: testing\nmx: mail.example.com\n",
+			false,
+		},
+		{
+			"version: STSv1\nmode: enforce\nmax_age: 604800\n", // no mx entries
+			true,
+		},
+		{
+			"mode: enforce\nmx: mail.example.com\n", // no version
+			true,
+		},
+		{
+			"version: STSv2\nmode: enforce\nmx: mail.example.com\n", // bad version
+			true,
+		},
+		{
+			"version: STSv1\nmode: bogus\nmx: mail.example.com\n", // bad mode
+			true,
+		},
+	}
+
+	for _, c := range cases {
+		_, err := parsePolicy(c.text)
+		if (err != nil) != c.wantErr {
+			t.Errorf("parsePolicy(%q) error = %v, wantErr %v", c.text, err, c.wantErr)
+		}
+	}
+}
+
+type fakeResponse struct {
+	status int
+	body   string
+	err    error
+}
+
+func TestDBGet(t *testing.T) {
+	dir := testlib.MustTempDir(t)
+	defer testlib.RemoveIfOk(t, dir)
+
+	db, err := New(dir)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	txts := map[string][]string{}
+	var resp fakeResponse
+
+	origLookupTXT, origHTTPGet := netLookupTXT, netHTTPGet
+	netLookupTXT = func(name string) ([]string, error) {
+		return txts[name], nil
+	}
+	netHTTPGet = func(url string) (*http.Response, error) {
+		if resp.err != nil {
+			return nil, resp.err
+		}
+		return &http.Response{
+			StatusCode: resp.status,
+			Status:     "some status",
+			Body:       io.NopCloser(strings.NewReader(resp.body)),
+		}, nil
+	}
+	defer func() {
+		netLookupTXT = origLookupTXT
+		netHTTPGet = origHTTPGet
+	}()
+
+	txts["_mta-sts.example.com"] = []string{"v=STSv1; id=20190429T010101"}
+	resp = fakeResponse{
+		status: 200,
+		body:   "version: STSv1\nmode: enforce\nmx: mail.example.com\nmax_age: 1\n",
+	}
+
+	p, err := db.Get("example.com")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if p.Mode != ModeEnforce || !p.Matches("mail.example.com") {
+		t.Errorf("unexpected policy: %+v", p)
+	}
+
+	// A second Get before max_age elapses should be served from cache,
+	// without calling netHTTPGet again.
+	resp = fakeResponse{err: errors.New("should not be called")}
+	if _, err := db.Get("example.com"); err != nil {
+		t.Errorf("cached Get failed: %v", err)
+	}
+
+	// Once the cached policy expires, a failed refresh should still
+	// return the last known-good policy rather than an error.
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := db.Get("example.com"); err != nil {
+		t.Errorf("expected fall back to cached policy on fetch error, got: %v", err)
+	}
+}
@@ -0,0 +1,30 @@
+// Package testlib contains small helpers commonly used in tests across the
+// codebase.
+package testlib
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// MustTempDir creates a new temporary directory, and returns its path.
+// It fails the test if the directory cannot be created.
+func MustTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "chasquid_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	return dir
+}
+
+// RemoveIfOk removes the given directory, but only if the test has not
+// failed. This makes it easier to inspect the directory's contents when
+// debugging a failing test.
+func RemoveIfOk(t *testing.T, dir string) {
+	if t.Failed() {
+		t.Logf("not removing %q, test failed", dir)
+		return
+	}
+	os.RemoveAll(dir)
+}
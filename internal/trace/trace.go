@@ -0,0 +1,48 @@
+// Package trace provides a thin wrapper for tracing and logging events
+// associated with a particular unit of work (an incoming connection, an
+// outgoing delivery attempt, etc).
+//
+// It exists mostly so call sites have a single place to log to, instead of
+// scattering log.Printf and event-tracing calls throughout the codebase.
+package trace
+
+import (
+	"fmt"
+	"log"
+)
+
+// Trace represents an in-progress unit of work, identified by a family and
+// a title (both free-form, used for logging purposes only).
+type Trace struct {
+	Family string
+	Title  string
+}
+
+// New creates a new Trace for the given family/title pair.
+func New(family, title string) *Trace {
+	return &Trace{Family: family, Title: title}
+}
+
+// Finish marks the trace as complete. It is a no-op for now, but gives
+// call sites a consistent `defer tr.Finish()` idiom to use, in case this
+// grows into something that needs cleanup (e.g. flushing to a tracing
+// backend) in the future.
+func (t *Trace) Finish() {}
+
+// Debugf logs a debug-level message associated with this trace.
+func (t *Trace) Debugf(format string, args ...interface{}) {
+	log.Printf("[%s %s] "+format, append([]interface{}{t.Family, t.Title}, args...)...)
+}
+
+// Printf logs a normal message associated with this trace.
+func (t *Trace) Printf(format string, args ...interface{}) {
+	log.Printf("[%s %s] "+format, append([]interface{}{t.Family, t.Title}, args...)...)
+}
+
+// Errorf logs an error message associated with this trace, and returns it
+// as an error, so it can be used as `return tr.Errorf(...)`.
+func (t *Trace) Errorf(format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	log.Printf("[%s %s] error: %v", t.Family, t.Title, err)
+	return err
+}